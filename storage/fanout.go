@@ -0,0 +1,104 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gwos/boxspy/info"
+)
+
+// Fanout writes each stat to every enabled output concurrently. Each output
+// keeps its own buffer and flush policy, so a slow or backed-up output never
+// delays the others.
+type Fanout struct {
+	outputs []Output
+}
+
+// NewFanout wraps a set of already-constructed outputs. It is the type
+// boxspy's main should hand its per-container stats to once it has built one
+// Output per enabled config section.
+func NewFanout(outputs ...Output) *Fanout {
+	return &Fanout{outputs: outputs}
+}
+
+// AddStats fans the write out to every output and waits for all of them to
+// finish. Errors from individual outputs are collected and joined so a
+// single failing backend doesn't hide failures in the others.
+func (f *Fanout) AddStats(ref info.ContainerReference, stats *info.ContainerStats) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(f.outputs))
+	for i, output := range f.outputs {
+		wg.Add(1)
+		go func(i int, output Output) {
+			defer wg.Done()
+			errs[i] = output.AddStats(ref, stats)
+		}(i, output)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("fanout: %d of %d outputs failed: %s", len(msgs), len(f.outputs), strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// RecentStats returns the numStats most recent stats from the first output
+// that can answer the query, trying each in turn. Unlike AddStats, reads
+// aren't fanned out and merged: "recent stats" is a single backend's view of
+// history, and most Outputs that can't serve reads (e.g. graphite, kafka)
+// return an error rather than an empty result, so falling through to the
+// next output on error is the useful behavior here.
+func (f *Fanout) RecentStats(containerName string, numStats int) ([]*info.ContainerStats, error) {
+	var lastErr error
+	for _, output := range f.outputs {
+		stats, err := output.RecentStats(containerName, numStats)
+		if err == nil {
+			return stats, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("fanout: no outputs configured")
+	}
+	return nil, lastErr
+}
+
+// OverrideReadyToFlush applies the same flush policy to every output.
+func (f *Fanout) OverrideReadyToFlush(readyToFlush func() bool) {
+	for _, output := range f.outputs {
+		output.OverrideReadyToFlush(readyToFlush)
+	}
+}
+
+// Close closes every output, returning the first error encountered while
+// still attempting to close the rest.
+func (f *Fanout) Close() error {
+	var first error
+	for _, output := range f.outputs {
+		if err := output.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
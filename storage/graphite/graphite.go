@@ -0,0 +1,202 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package graphite implements a storage.Output that writes container stats
+// as Graphite plaintext ("carbon") lines over TCP.
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwos/boxspy/info"
+	"github.com/gwos/boxspy/storage"
+)
+
+const defaultTemplate = "host.measurement.field"
+
+func init() {
+	storage.Register("graphite", newFromConfig)
+}
+
+func newFromConfig(config map[string]string) (storage.Output, error) {
+	bufferDuration, err := time.ParseDuration(config["buffer_duration"])
+	if err != nil {
+		bufferDuration = 10 * time.Second
+	}
+	template := config["template"]
+	if template == "" {
+		template = defaultTemplate
+	}
+	return New(config["machine_name"], config["measurement"], config["address"], template, bufferDuration)
+}
+
+type point struct {
+	path      string
+	value     interface{}
+	timestamp time.Time
+}
+
+type graphiteStorage struct {
+	address        string
+	template       string
+	machineName    string
+	measurement    string
+	bufferDuration time.Duration
+	lastWrite      time.Time
+	points         []point
+	lock           sync.Mutex
+	readyToFlush   func() bool
+}
+
+// New returns an output that writes stats to a Carbon-compatible TCP
+// endpoint at address ("host:2003"). template controls how each metric's
+// dotted path is built out of the tokens "host", "measurement" and "field",
+// e.g. the default "host.measurement.field" yields
+// "myhost.stats.mycontainer.cpu_cumulative_usage".
+func New(machineName, measurement, address, template string, bufferDuration time.Duration) (*graphiteStorage, error) {
+	if template == "" {
+		template = defaultTemplate
+	}
+	ret := &graphiteStorage{
+		address:        address,
+		template:       template,
+		machineName:    machineName,
+		measurement:    measurement,
+		bufferDuration: bufferDuration,
+		lastWrite:      time.Now(),
+		points:         make([]point, 0),
+	}
+	ret.readyToFlush = ret.defaultReadyToFlush
+	return ret, nil
+}
+
+func (self *graphiteStorage) defaultReadyToFlush() bool {
+	return time.Since(self.lastWrite) >= self.bufferDuration
+}
+
+func (self *graphiteStorage) OverrideReadyToFlush(readyToFlush func() bool) {
+	self.readyToFlush = readyToFlush
+}
+
+// sanitize keeps stray dots out of a path component so they can't be
+// mistaken for the template's own separators.
+func sanitize(s string) string {
+	return strings.Replace(s, ".", "_", -1)
+}
+
+func (self *graphiteStorage) path(containerName, field string) string {
+	tokens := strings.Split(self.template, ".")
+	parts := make([]string, 0, len(tokens)+1)
+	for _, tok := range tokens {
+		switch tok {
+		case "host":
+			parts = append(parts, sanitize(self.machineName))
+		case "measurement":
+			parts = append(parts, sanitize(self.measurement), sanitize(containerName))
+		case "field":
+			parts = append(parts, sanitize(field))
+		default:
+			parts = append(parts, sanitize(tok))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func (self *graphiteStorage) containerStatsToPoints(ref info.ContainerReference, stats *info.ContainerStats) []point {
+	containerName := ref.Name
+	if len(ref.Aliases) > 0 {
+		containerName = ref.Aliases[0]
+	}
+
+	fields := map[string]interface{}{
+		"cpu_cumulative_usage": stats.Cpu.Usage.Total,
+		"memory_usage":         stats.Memory.Usage,
+		"memory_working_set":   stats.Memory.WorkingSet,
+	}
+	if stats.Network != nil {
+		fields["rx_bytes"] = stats.Network.RxBytes
+		fields["rx_errors"] = stats.Network.RxErrors
+		fields["tx_bytes"] = stats.Network.TxBytes
+		fields["tx_errors"] = stats.Network.TxErrors
+	}
+
+	points := make([]point, 0, len(fields)+2*len(stats.Filesystem))
+	for field, value := range fields {
+		points = append(points, point{
+			path:      self.path(containerName, field),
+			value:     value,
+			timestamp: stats.Timestamp,
+		})
+	}
+	for _, fsStat := range stats.Filesystem {
+		device := sanitize(fsStat.Device)
+		points = append(points,
+			point{path: self.path(containerName, "fs."+device+".limit"), value: fsStat.Limit, timestamp: stats.Timestamp},
+			point{path: self.path(containerName, "fs."+device+".usage"), value: fsStat.Usage, timestamp: stats.Timestamp},
+		)
+	}
+	return points
+}
+
+func (self *graphiteStorage) AddStats(ref info.ContainerReference, stats *info.ContainerStats) error {
+	if stats == nil || stats.Cpu == nil || stats.Memory == nil {
+		return nil
+	}
+	var pointsToFlush []point
+	func() {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		self.points = append(self.points, self.containerStatsToPoints(ref, stats)...)
+		if self.readyToFlush() {
+			pointsToFlush = self.points
+			self.points = make([]point, 0)
+			self.lastWrite = time.Now()
+		}
+	}()
+	if len(pointsToFlush) > 0 {
+		if err := self.writeBatch(pointsToFlush); err != nil {
+			return fmt.Errorf("failed to write stats to graphite - %s", err)
+		}
+	}
+	return nil
+}
+
+func (self *graphiteStorage) writeBatch(points []point) error {
+	conn, err := net.DialTimeout("tcp", self.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	for _, p := range points {
+		fmt.Fprintf(&buf, "%s %v %d\n", p.path, p.value, p.timestamp.Unix())
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+func (self *graphiteStorage) RecentStats(containerName string, numStats int) ([]*info.ContainerStats, error) {
+	return nil, fmt.Errorf("graphite: RecentStats is not supported, graphite exposes no read API for line-protocol writes")
+}
+
+func (self *graphiteStorage) Close() error {
+	return nil
+}
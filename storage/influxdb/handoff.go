@@ -0,0 +1,366 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// HandoffConfig controls the disk-backed hinted-handoff queue that
+// influxdbStorage falls back to when a write to InfluxDB fails. An empty Dir
+// disables handoff entirely: failed writes are simply returned as errors, as
+// before.
+type HandoffConfig struct {
+	// Dir is where segment files are kept. Created if it doesn't exist.
+	Dir string
+	// MaxBytes bounds the total size of queued segments; once exceeded, the
+	// oldest queued batches are dropped to make room for new ones.
+	MaxBytes int64
+	// MaxAge bounds how long a queued batch is kept before being dropped
+	// unreplayed.
+	MaxAge time.Duration
+}
+
+// HandoffStats is a snapshot of the handoff queue: QueuedBatches and
+// QueueBytes describe the segments on disk now, while ReplayedBatches and
+// DroppedBatches count since the queue was opened.
+type HandoffStats struct {
+	QueuedBatches   uint64
+	ReplayedBatches uint64
+	DroppedBatches  uint64
+	QueueBytes      int64
+}
+
+const (
+	handoffMinBackoff = 500 * time.Millisecond
+	handoffMaxBackoff = 60 * time.Second
+	handoffJitter     = 0.2
+)
+
+// handoffQueue persists batches that failed to write to InfluxDB as segment
+// files, and replays them in order in the background once the server
+// recovers. It's modeled on InfluxDB's own cluster hinted-handoff queue.
+type handoffQueue struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	write    func([]*client.Point) error
+
+	mu    sync.Mutex
+	bytes int64
+	seq   uint64
+
+	queuedBatches   uint64
+	replayedBatches uint64
+	droppedBatches  uint64
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// handoffPoint is the JSON-serializable stand-in for a client.Point, which
+// keeps its fields unexported and so can't be encoded directly.
+type handoffPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Timestamp   time.Time              `json:"timestamp"`
+}
+
+// newHandoffQueue creates a handoff queue rooted at cfg.Dir, loads any
+// segments left over from a previous run, and starts the background replay
+// loop that calls write once segments are ready to retry.
+func newHandoffQueue(cfg HandoffConfig, write func([]*client.Point) error) (*handoffQueue, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create handoff dir %s: %s", cfg.Dir, err)
+	}
+	q := &handoffQueue{
+		dir:      cfg.Dir,
+		maxBytes: cfg.MaxBytes,
+		maxAge:   cfg.MaxAge,
+		write:    write,
+		stopCh:   make(chan struct{}),
+	}
+	segments, err := q.segmentPaths()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range segments {
+		if fi, err := os.Stat(path); err == nil {
+			q.bytes += fi.Size()
+			q.queuedBatches++
+		}
+	}
+	q.wg.Add(1)
+	go q.replayLoop()
+	return q, nil
+}
+
+func (q *handoffQueue) segmentPaths() ([]string, error) {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ".seg" {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = filepath.Join(q.dir, name)
+	}
+	return paths, nil
+}
+
+// enqueue persists points as a new segment file. It is called with a batch
+// that just failed to write to InfluxDB.
+func (q *handoffQueue) enqueue(points []*client.Point) error {
+	encoded := make([]handoffPoint, 0, len(points))
+	for _, p := range points {
+		fields, err := p.Fields()
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, handoffPoint{
+			Measurement: p.Name(),
+			Tags:        p.Tags(),
+			Fields:      fields,
+			Timestamp:   p.Time(),
+		})
+	}
+	payload, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	path := filepath.Join(q.dir, fmt.Sprintf("%020d-%010d.seg", time.Now().UnixNano(), q.seq))
+	if err := writeSegment(path, payload); err != nil {
+		return err
+	}
+	q.bytes += int64(4 + len(payload))
+	q.queuedBatches++
+	q.enforceMaxBytesLocked()
+	return nil
+}
+
+// enforceMaxBytesLocked drops the oldest queued segments until the queue
+// fits within maxBytes. Callers must hold q.mu.
+func (q *handoffQueue) enforceMaxBytesLocked() {
+	if q.maxBytes <= 0 || q.bytes <= q.maxBytes {
+		return
+	}
+	segments, err := q.segmentPaths()
+	if err != nil {
+		return
+	}
+	for _, path := range segments {
+		if q.bytes <= q.maxBytes {
+			break
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			continue
+		}
+		q.bytes -= fi.Size()
+		q.droppedBatches++
+	}
+}
+
+// writeSegment writes a single length-prefixed record so a crash mid-write
+// leaves only the last segment truncated, never corrupting the ones before
+// it or the payload's own framing.
+func writeSegment(path string, payload []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	if _, err := f.Write(header); err != nil {
+		return err
+	}
+	if _, err := f.Write(payload); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readSegment(path string) ([]handoffPoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("truncated segment %s", path)
+	}
+	length := binary.BigEndian.Uint32(data[:4])
+	if int(length) > len(data)-4 {
+		return nil, fmt.Errorf("truncated segment %s", path)
+	}
+	var points []handoffPoint
+	if err := json.Unmarshal(data[4:4+length], &points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func (q *handoffQueue) toClientPoints(points []handoffPoint) ([]*client.Point, error) {
+	out := make([]*client.Point, 0, len(points))
+	for _, p := range points {
+		point, err := client.NewPoint(p.Measurement, p.Tags, p.Fields, p.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, point)
+	}
+	return out, nil
+}
+
+// replayLoop retries the oldest queued segment on an exponential backoff,
+// capped at handoffMaxBackoff, resetting to handoffMinBackoff after every
+// success so a brief outage doesn't leave the queue sluggish afterwards.
+func (q *handoffQueue) replayLoop() {
+	defer q.wg.Done()
+	backoff := handoffMinBackoff
+	for {
+		replayed, err := q.replayOldest()
+		if err != nil {
+			backoff = withJitter(nextBackoff(backoff))
+		} else if replayed {
+			backoff = handoffMinBackoff
+			continue // more segments may be waiting; don't sleep between them
+		} else {
+			backoff = handoffMinBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-q.stopCh:
+			return
+		}
+	}
+}
+
+// replayOldest attempts to write the oldest queued segment. It returns
+// replayed=true if a segment was found and either successfully written or
+// dropped because it was older than maxAge or could not be decoded.
+func (q *handoffQueue) replayOldest() (replayed bool, err error) {
+	segments, err := q.segmentPaths()
+	if err != nil || len(segments) == 0 {
+		return false, err
+	}
+	path := segments[0]
+
+	if fi, statErr := os.Stat(path); statErr == nil && q.maxAge > 0 && time.Since(fi.ModTime()) > q.maxAge {
+		q.dropSegment(path, fi.Size())
+		return true, nil
+	}
+
+	encoded, err := readSegment(path)
+	if err != nil {
+		// A corrupt segment can never be replayed; drop it rather than
+		// wedging the whole queue behind it.
+		if fi, statErr := os.Stat(path); statErr == nil {
+			q.dropSegment(path, fi.Size())
+		}
+		return true, nil
+	}
+	points, err := q.toClientPoints(encoded)
+	if err != nil {
+		return false, err
+	}
+	if err := q.write(points); err != nil {
+		return false, err
+	}
+
+	fi, statErr := os.Stat(path)
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	q.mu.Lock()
+	if statErr == nil {
+		q.bytes -= fi.Size()
+	}
+	q.replayedBatches++
+	q.mu.Unlock()
+	return true, nil
+}
+
+func (q *handoffQueue) dropSegment(path string, size int64) {
+	if err := os.Remove(path); err != nil {
+		return
+	}
+	q.mu.Lock()
+	q.bytes -= size
+	q.droppedBatches++
+	q.mu.Unlock()
+}
+
+func nextBackoff(cur time.Duration) time.Duration {
+	next := cur * 2
+	if next > handoffMaxBackoff {
+		next = handoffMaxBackoff
+	}
+	return next
+}
+
+func withJitter(d time.Duration) time.Duration {
+	delta := float64(d) * handoffJitter
+	offset := (rand.Float64()*2 - 1) * delta
+	return time.Duration(float64(d) + offset)
+}
+
+func (q *handoffQueue) stats() HandoffStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return HandoffStats{
+		QueuedBatches:   q.queuedBatches - q.replayedBatches - q.droppedBatches,
+		ReplayedBatches: q.replayedBatches,
+		DroppedBatches:  q.droppedBatches,
+		QueueBytes:      q.bytes,
+	}
+}
+
+// Close stops the replay goroutine. Segments not yet replayed are left on
+// disk so the next process to open this directory picks up where this one
+// left off.
+func (q *handoffQueue) Close() error {
+	q.stopOnce.Do(func() { close(q.stopCh) })
+	q.wg.Wait()
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func writeTestSegment(t *testing.T, path string, points []handoffPoint) {
+	t.Helper()
+	payload, err := json.Marshal(points)
+	if err != nil {
+		t.Fatalf("failed to marshal test segment: %s", err)
+	}
+	if err := writeSegment(path, payload); err != nil {
+		t.Fatalf("failed to write test segment: %s", err)
+	}
+}
+
+// TestHandoffQueueReplaysInOrderAfterRestart simulates a process restart by
+// writing segments to disk before a handoffQueue ever exists, then checks
+// that the queue picks them up and replays them oldest-first.
+func TestHandoffQueueReplaysInOrderAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boxspy-handoff")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, name := range []string{
+		"00000000000000000001-0000000001.seg",
+		"00000000000000000002-0000000002.seg",
+		"00000000000000000003-0000000003.seg",
+	} {
+		writeTestSegment(t, filepath.Join(dir, name), []handoffPoint{
+			{Measurement: "stats", Fields: map[string]interface{}{"seq": float64(i)}, Timestamp: time.Unix(0, int64(i))},
+		})
+	}
+
+	var mu sync.Mutex
+	var replayedSeqs []float64
+	write := func(points []*client.Point) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, p := range points {
+			fields, err := p.Fields()
+			if err != nil {
+				return err
+			}
+			replayedSeqs = append(replayedSeqs, fields["seq"].(float64))
+		}
+		return nil
+	}
+
+	q, err := newHandoffQueue(HandoffConfig{Dir: dir}, write)
+	if err != nil {
+		t.Fatalf("newHandoffQueue failed: %s", err)
+	}
+	defer q.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(replayedSeqs)
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for replay, got %d of 3 segments", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []float64{0, 1, 2}; !reflect.DeepEqual(replayedSeqs, want) {
+		t.Fatalf("replayed out of order: got %v, want %v", replayedSeqs, want)
+	}
+
+	stats := q.stats()
+	if stats.ReplayedBatches != 3 || stats.QueuedBatches != 0 {
+		t.Fatalf("stats after replay = %+v, want 3 replayed and 0 queued", stats)
+	}
+}
+
+// TestHandoffQueueDropsTruncatedSegment simulates a crash mid-write: the
+// segment's length prefix claims more payload bytes than are on disk. It
+// should be recognized as unreplayable and dropped rather than wedging the
+// queue behind it forever.
+func TestHandoffQueueDropsTruncatedSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boxspy-handoff")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "00000000000000000001-0000000001.seg")
+	writeTestSegment(t, path, []handoffPoint{
+		{Measurement: "stats", Fields: map[string]interface{}{"seq": float64(0)}, Timestamp: time.Unix(0, 0)},
+	})
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat segment: %s", err)
+	}
+	if err := os.Truncate(path, fi.Size()-5); err != nil {
+		t.Fatalf("failed to truncate segment: %s", err)
+	}
+
+	if _, err := readSegment(path); err == nil {
+		t.Fatalf("readSegment on a truncated segment: want error, got nil")
+	}
+
+	var writes int32
+	write := func(points []*client.Point) error {
+		atomic.AddInt32(&writes, 1)
+		return nil
+	}
+
+	q, err := newHandoffQueue(HandoffConfig{Dir: dir}, write)
+	if err != nil {
+		t.Fatalf("newHandoffQueue failed: %s", err)
+	}
+	defer q.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		segments, err := q.segmentPaths()
+		if err != nil {
+			t.Fatalf("segmentPaths failed: %s", err)
+		}
+		if len(segments) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("truncated segment was never dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := atomic.LoadInt32(&writes); got != 0 {
+		t.Fatalf("write called %d times, want 0 for an undecodable segment", got)
+	}
+
+	stats := q.stats()
+	if stats.DroppedBatches != 1 {
+		t.Fatalf("stats.DroppedBatches = %d, want 1", stats.DroppedBatches)
+	}
+}
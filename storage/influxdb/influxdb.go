@@ -16,28 +16,68 @@ package influxdb
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gwos/boxspy/info"
-	influxdb "github.com/influxdb/influxdb/client"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
 )
 
 type influxdbStorage struct {
-	client         *influxdb.Client
-	machineName    string
-	tableName      string
-	bufferDuration time.Duration
-	lastWrite      time.Time
-	series         []*influxdb.Series
-	lock           sync.Mutex
-	readyToFlush   func() bool
+	client           client.Client
+	machineName      string
+	tableName        string
+	database         string
+	retentionPolicy  string
+	writeConsistency string
+	bufferDuration   time.Duration
+	lastWrite        time.Time
+	points           []*client.Point
+	lock             sync.Mutex
+	readyToFlush     func() bool
+	handoff          *handoffQueue
+	labelFilter      LabelFilter
+}
+
+// LabelFilter decides which Docker labels get copied onto series as tags.
+// An empty Allow means no labels are candidates: only labels named in Allow
+// are copied, and Deny is checked afterwards and always wins. This keeps
+// unbounded user-supplied labels from blowing up series cardinality by
+// default; operators opt a label in rather than opting one out.
+type LabelFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+func (f LabelFilter) allows(key string) bool {
+	allowed := false
+	for _, k := range f.Allow {
+		if k == key {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	for _, k := range f.Deny {
+		if k == key {
+			return false
+		}
+	}
+	return true
 }
 
 const (
 	colTimestamp          string = "time"
 	colMachineName        string = "machine"
 	colContainerName      string = "container_name"
+	// First container alias, tagged separately from container_name so a
+	// container can be queried/grouped by its alias independently of its
+	// name. Omitted when the container has no aliases.
+	colContainerAlias     string = "container_alias"
 	colCpuCumulativeUsage string = "cpu_cumulative_usage"
 	// Memory Usage
 	colMemoryUsage string = "memory_usage"
@@ -57,88 +97,141 @@ const (
 	colFsLimit = "fs_limit"
 	// Filesystem usage.
 	colFsUsage = "fs_usage"
+	// Per-cpu usage, tagged with which cpu it came from.
+	colCpu      = "cpu"
+	colCpuUsage = "cpu_usage"
+	// Network interface, tagged onto per-interface breakdown series.
+	colInterface = "interface"
+	// Prefix applied to Docker label keys copied onto series as tags, so
+	// they can't collide with the fixed tag names above.
+	labelTagPrefix = "label_"
 )
 
-func (self *influxdbStorage) getSeriesDefaultValues(
-	ref info.ContainerReference,
-	stats *info.ContainerStats,
-	columns []string,
-	values []interface{}) {
-	// Timestamp
-	columns = append(columns, colTimestamp)
-	values = append(values, stats.Timestamp.UnixNano()/1E3)
-
-	// Machine name
-	columns = append(columns, colMachineName)
-	values = append(values, self.machineName)
-
-	// Container name
-	columns = append(columns, colContainerName)
+// getSeriesDefaultTags returns the tag set shared by every point written for
+// a container: machine and container identity, plus any Docker labels that
+// pass self.labelFilter. These stay tags, not fields, so influxDB indexes
+// them and RecentStats can filter on them efficiently.
+func (self *influxdbStorage) getSeriesDefaultTags(ref info.ContainerReference) map[string]string {
+	tags := map[string]string{
+		colMachineName:   self.machineName,
+		colContainerName: ref.Name,
+	}
 	if len(ref.Aliases) > 0 {
-		values = append(values, ref.Aliases[0])
-	} else {
-		values = append(values, ref.Name)
+		tags[colContainerAlias] = ref.Aliases[0]
+	}
+	for k, v := range ref.Labels {
+		if self.labelFilter.allows(k) {
+			tags[labelTagPrefix+k] = v
+		}
 	}
+	return tags
+}
+
+// cloneTags copies a tag set so it can be specialized (e.g. with a cpu or
+// interface tag) without mutating the caller's copy.
+func cloneTags(tags map[string]string) map[string]string {
+	out := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		out[k] = v
+	}
+	return out
 }
 
-// In order to maintain a fixed column format, we add a new series for each filesystem partition.
-func (self *influxdbStorage) containerFilesystemStatsToSeries(
+// In order to maintain a fixed field format, we emit a separate point for
+// each filesystem partition, tagged with its device.
+func (self *influxdbStorage) containerFilesystemStatsToPoints(
 	ref info.ContainerReference,
-	stats *info.ContainerStats) (series []*influxdb.Series) {
+	stats *info.ContainerStats) (points []*client.Point) {
 	if len(stats.Filesystem) == 0 {
-		return series
+		return points
 	}
 	for _, fsStat := range stats.Filesystem {
-		columns := make([]string, 0)
-		values := make([]interface{}, 0)
-		self.getSeriesDefaultValues(ref, stats, columns, values)
+		tags := self.getSeriesDefaultTags(ref)
+		tags[colFsDevice] = fsStat.Device
 
-		columns = append(columns, colFsDevice)
-		values = append(values, fsStat.Device)
-
-		columns = append(columns, colFsLimit)
-		values = append(values, fsStat.Limit)
-
-		columns = append(columns, colFsUsage)
-		values = append(values, fsStat.Usage)
-		series = append(series, self.newSeries(columns, values))
+		fields := map[string]interface{}{
+			colFsLimit: fsStat.Limit,
+			colFsUsage: fsStat.Usage,
+		}
+		point, err := client.NewPoint(self.tableName, tags, fields, stats.Timestamp)
+		if err != nil {
+			continue
+		}
+		points = append(points, point)
 	}
-	return series
+	return points
 }
 
 func (self *influxdbStorage) containerStatsToValues(
 	ref info.ContainerReference,
 	stats *info.ContainerStats,
-) (columns []string, values []interface{}) {
-	self.getSeriesDefaultValues(ref, stats, columns, values)
-	// Cumulative Cpu Usage
-	columns = append(columns, colCpuCumulativeUsage)
-	values = append(values, stats.Cpu.Usage.Total)
-
-	// Memory Usage
-	columns = append(columns, colMemoryUsage)
-	values = append(values, stats.Memory.Usage)
-
-	// Working set size
-	columns = append(columns, colMemoryWorkingSet)
-	values = append(values, stats.Memory.WorkingSet)
+) (tags map[string]string, fields map[string]interface{}) {
+	tags = self.getSeriesDefaultTags(ref)
+	fields = map[string]interface{}{
+		colCpuCumulativeUsage: stats.Cpu.Usage.Total,
+		colMemoryUsage:        stats.Memory.Usage,
+		colMemoryWorkingSet:   stats.Memory.WorkingSet,
+	}
 
 	// Optional: Network stats.
 	if stats.Network != nil {
-		columns = append(columns, colRxBytes)
-		values = append(values, stats.Network.RxBytes)
-
-		columns = append(columns, colRxErrors)
-		values = append(values, stats.Network.RxErrors)
+		fields[colRxBytes] = stats.Network.RxBytes
+		fields[colRxErrors] = stats.Network.RxErrors
+		fields[colTxBytes] = stats.Network.TxBytes
+		fields[colTxErrors] = stats.Network.TxErrors
+	}
 
-		columns = append(columns, colTxBytes)
-		values = append(values, stats.Network.TxBytes)
+	return tags, fields
+}
 
-		columns = append(columns, colTxErrors)
-		values = append(values, stats.Network.TxErrors)
+// containerPerCpuStatsToPoints emits one point per entry in
+// stats.Cpu.Usage.PerCpu, tagged with which cpu it came from, so per-core
+// usage can be graphed and queried independently of the aggregate total.
+func (self *influxdbStorage) containerPerCpuStatsToPoints(
+	ref info.ContainerReference,
+	stats *info.ContainerStats) (points []*client.Point) {
+	tags := self.getSeriesDefaultTags(ref)
+	for cpu, usage := range stats.Cpu.Usage.PerCpu {
+		cpuTags := cloneTags(tags)
+		cpuTags[colCpu] = strconv.Itoa(cpu)
+		point, err := client.NewPoint(self.tableName, cpuTags, map[string]interface{}{
+			colCpuUsage: usage,
+		}, stats.Timestamp)
+		if err != nil {
+			continue
+		}
+		points = append(points, point)
 	}
+	return points
+}
 
-	return columns, values
+// containerPerInterfaceStatsToPoints emits one point per network interface,
+// tagged with its name, but only when there's more than one to distinguish -
+// with a single interface the aggregate fields on the main point already
+// cover it and a redundant series would just add cardinality.
+func (self *influxdbStorage) containerPerInterfaceStatsToPoints(
+	ref info.ContainerReference,
+	stats *info.ContainerStats) (points []*client.Point) {
+	if stats.Network == nil || len(stats.Network.Interfaces) < 2 {
+		return points
+	}
+	tags := self.getSeriesDefaultTags(ref)
+	for _, iface := range stats.Network.Interfaces {
+		ifaceTags := cloneTags(tags)
+		ifaceTags[colInterface] = iface.Name
+		fields := map[string]interface{}{
+			colRxBytes:  iface.RxBytes,
+			colRxErrors: iface.RxErrors,
+			colTxBytes:  iface.TxBytes,
+			colTxErrors: iface.TxErrors,
+		}
+		point, err := client.NewPoint(self.tableName, ifaceTags, fields, stats.Timestamp)
+		if err != nil {
+			continue
+		}
+		points = append(points, point)
+	}
+	return points
 }
 
 func convertToUint64(v interface{}) (uint64, error) {
@@ -174,6 +267,15 @@ func convertToUint64(v interface{}) (uint64, error) {
 	return 0, fmt.Errorf("Unknown type")
 }
 
+// valuesToContainerStats reconstructs one row's worth of the aggregate
+// per-sample point written by containerStatsToValues: cpu/memory totals,
+// aggregate network counters, and (via the caller's row loop) filesystem
+// breakdowns. It intentionally does not reconstruct per-cpu or
+// per-interface breakdowns, since RecentStats excludes those auxiliary,
+// separately-tagged rows rather than re-merging them back into a single
+// row per timestamp. Docker labels never round-trip either: they belong to
+// info.ContainerReference, which RecentStats doesn't return, and
+// info.ContainerStats has nowhere to put them.
 func (self *influxdbStorage) valuesToContainerStats(columns []string, values []interface{}) (*info.ContainerStats, error) {
 	stats := &info.ContainerStats{
 		Cpu:        &info.CpuStats{},
@@ -264,117 +366,201 @@ func (self *influxdbStorage) AddStats(ref info.ContainerReference, stats *info.C
 	if stats == nil || stats.Cpu == nil || stats.Memory == nil {
 		return nil
 	}
-	var seriesToFlush []*influxdb.Series
+	var pointsToFlush []*client.Point
 	func() {
 		// AddStats will be invoked simultaneously from multiple threads and only one of them will perform a write.
 		self.lock.Lock()
 		defer self.lock.Unlock()
 
-		self.series = append(self.series, self.newSeries(self.containerStatsToValues(ref, stats)))
-		self.series = append(self.series, self.containerFilesystemStatsToSeries(ref, stats)...)
+		tags, fields := self.containerStatsToValues(ref, stats)
+		if point, err := client.NewPoint(self.tableName, tags, fields, stats.Timestamp); err == nil {
+			self.points = append(self.points, point)
+		}
+		self.points = append(self.points, self.containerFilesystemStatsToPoints(ref, stats)...)
+		self.points = append(self.points, self.containerPerCpuStatsToPoints(ref, stats)...)
+		self.points = append(self.points, self.containerPerInterfaceStatsToPoints(ref, stats)...)
 		if self.readyToFlush() {
-			seriesToFlush = self.series
-			self.series = make([]*influxdb.Series, 0)
+			pointsToFlush = self.points
+			self.points = make([]*client.Point, 0)
 			self.lastWrite = time.Now()
 		}
 	}()
-	if len(seriesToFlush) > 0 {
-		err := self.client.WriteSeriesWithTimePrecision(seriesToFlush, influxdb.Microsecond)
-		if err != nil {
-			return fmt.Errorf("failed to write stats to influxDb - %s", err)
+	if len(pointsToFlush) > 0 {
+		if err := self.writeBatch(pointsToFlush); err != nil {
+			if self.handoff == nil {
+				return fmt.Errorf("failed to write stats to influxDb - %s", err)
+			}
+			if qerr := self.handoff.enqueue(pointsToFlush); qerr != nil {
+				return fmt.Errorf("failed to write stats to influxDb (%s) and failed to queue for handoff - %s", err, qerr)
+			}
 		}
 	}
 
 	return nil
 }
 
+// HandoffStats reports the current state of the hinted-handoff queue.
+// The zero value is returned when handoff is disabled.
+func (self *influxdbStorage) HandoffStats() HandoffStats {
+	if self.handoff == nil {
+		return HandoffStats{}
+	}
+	return self.handoff.stats()
+}
+
+func (self *influxdbStorage) writeBatch(points []*client.Point) error {
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:         self.database,
+		RetentionPolicy:  self.retentionPolicy,
+		Precision:        "us",
+		WriteConsistency: self.writeConsistency,
+	})
+	if err != nil {
+		return err
+	}
+	bp.AddPoints(points)
+	return self.client.Write(bp)
+}
+
 func (self *influxdbStorage) RecentStats(containerName string, numStats int) ([]*info.ContainerStats, error) {
 	if numStats == 0 {
 		return nil, nil
 	}
 	// TODO(dengnan): select only columns that we need
-	// TODO(dengnan): escape names
-	query := fmt.Sprintf("select * from %v where %v='%v' and %v='%v'", self.tableName, colContainerName, containerName, colMachineName, self.machineName)
+	//
+	// containerPerCpuStatsToPoints and containerPerInterfaceStatsToPoints
+	// write their own auxiliary points into this same measurement, tagged
+	// with cpu/interface respectively, so they don't get merged into the
+	// aggregate series. Excluding series that carry either tag keeps this
+	// query limited to the real per-sample points: InfluxDB treats a tag a
+	// series doesn't have as equal to '', so this also matches untagged
+	// series as expected.
+	query := fmt.Sprintf("select * from %s where %s='%s' and %s='%s' and %s='' and %s='' order by time desc",
+		influxql.QuoteIdent(self.tableName),
+		colContainerName, influxql.QuoteString(containerName),
+		colMachineName, influxql.QuoteString(self.machineName),
+		colCpu, colInterface)
 	if numStats > 0 {
-		query = fmt.Sprintf("%v limit %v", query, numStats)
+		query = fmt.Sprintf("%s limit %d", query, numStats)
 	}
-	series, err := self.client.Query(query)
+	resp, err := self.client.Query(client.NewQuery(query, self.database, ""))
 	if err != nil {
 		return nil, err
 	}
-	statsList := make([]*info.ContainerStats, 0, len(series))
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+	statsList := make([]*info.ContainerStats, 0)
 	// By default, influxDB returns data in time descending order.
 	// RecentStats() requires stats in time increasing order,
 	// so we need to go through from the last one to the first one.
-	for i := len(series) - 1; i >= 0; i-- {
-		s := series[i]
-
-		for j := len(s.Points) - 1; j >= 0; j-- {
-			values := s.Points[j]
-			stats, err := self.valuesToContainerStats(s.Columns, values)
-			if err != nil {
-				return nil, err
-			}
-			if stats == nil {
-				continue
+	for _, result := range resp.Results {
+		for _, s := range result.Series {
+			for j := len(s.Values) - 1; j >= 0; j-- {
+				stats, err := self.valuesToContainerStats(s.Columns, s.Values[j])
+				if err != nil {
+					return nil, err
+				}
+				if stats == nil {
+					continue
+				}
+				statsList = append(statsList, stats)
 			}
-			statsList = append(statsList, stats)
 		}
 	}
 	return statsList, nil
 }
 
 func (self *influxdbStorage) Close() error {
+	if self.handoff != nil {
+		self.handoff.Close()
+	}
 	self.client = nil
 	return nil
 }
 
-// Returns a new influxdb series.
-func (self *influxdbStorage) newSeries(columns []string, points []interface{}) *influxdb.Series {
-	out := &influxdb.Series{
-		Name:    self.tableName,
-		Columns: columns,
-		// There's only one point for each stats
-		Points: make([][]interface{}, 1),
-	}
-	out.Points[0] = points
-	return out
+// Config bundles everything needed to construct an influxdb-backed
+// storage.Output: the target server and credentials, write
+// buffering/consistency, and the optional features (hinted handoff, label
+// filtering, retention provisioning) layered on top of the original client.
+// Grow this struct when the backend needs another knob, rather than adding
+// another NewWithX wrapper around New.
+type Config struct {
+	// MachineName is a unique identifier for the host the current cAdvisor
+	// instance is running on.
+	MachineName string
+	TableName   string
+	Database    string
+	Username    string
+	Password    string
+	// InfluxDBHost is the host which runs influxdb.
+	InfluxDBHost   string
+	IsSecure       bool
+	BufferDuration time.Duration
+	// RetentionPolicy and WriteConsistency pin writes to a specific
+	// retention policy and consistency level instead of relying on server
+	// defaults. WriteConsistency defaults to "any" when empty.
+	RetentionPolicy  string
+	WriteConsistency string
+	// Handoff enables disk-backed hinted handoff for batches that fail to
+	// write: when Handoff.Dir is non-empty, failed writes are queued to disk
+	// and replayed in the background instead of being dropped. The zero
+	// value disables it.
+	Handoff HandoffConfig
+	// LabelFilter bounds which Docker labels get copied onto series as tags.
+	LabelFilter LabelFilter
+	// Retention provisions the given retention policies and continuous
+	// queries on the target database before New returns, so writes land in
+	// the right retention policy and downsampling is set up from the very
+	// first sample. The zero value provisions nothing.
+	Retention RetentionSetup
 }
 
-// machineName: A unique identifier to identify the host that current cAdvisor
-// instance is running on.
-// influxdbHost: The host which runs influxdb.
-func New(machineName,
-	tablename,
-	database,
-	username,
-	password,
-	influxdbHost string,
-	isSecure bool,
-	bufferDuration time.Duration,
-) (*influxdbStorage, error) {
-	config := &influxdb.ClientConfig{
-		Host:     influxdbHost,
-		Username: username,
-		Password: password,
-		Database: database,
-		IsSecure: isSecure,
-	}
-	client, err := influxdb.NewClient(config)
+// New builds an influxdb-backed storage.Output from cfg.
+func New(cfg Config) (*influxdbStorage, error) {
+	if cfg.WriteConsistency == "" {
+		cfg.WriteConsistency = "any"
+	}
+	scheme := "http"
+	if cfg.IsSecure {
+		scheme = "https"
+	}
+	c, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:     fmt.Sprintf("%s://%s", scheme, cfg.InfluxDBHost),
+		Username: cfg.Username,
+		Password: cfg.Password,
+	})
 	if err != nil {
 		return nil, err
 	}
-	// TODO(monnand): With go 1.3, we cannot compress data now.
-	client.DisableCompression()
 
 	ret := &influxdbStorage{
-		client:         client,
-		machineName:    machineName,
-		tableName:      tablename,
-		bufferDuration: bufferDuration,
-		lastWrite:      time.Now(),
-		series:         make([]*influxdb.Series, 0),
+		client:           c,
+		machineName:      cfg.MachineName,
+		tableName:        cfg.TableName,
+		database:         cfg.Database,
+		retentionPolicy:  cfg.RetentionPolicy,
+		writeConsistency: cfg.WriteConsistency,
+		bufferDuration:   cfg.BufferDuration,
+		lastWrite:        time.Now(),
+		points:           make([]*client.Point, 0),
+		labelFilter:      cfg.LabelFilter,
 	}
 	ret.readyToFlush = ret.defaultReadyToFlush
+
+	if cfg.Handoff.Dir != "" {
+		queue, err := newHandoffQueue(cfg.Handoff, ret.writeBatch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up hinted-handoff queue: %s", err)
+		}
+		ret.handoff = queue
+	}
+
+	if len(cfg.Retention.Policies) > 0 || len(cfg.Retention.ContinuousQueries) > 0 {
+		if err := ret.provisionRetention(cfg.Retention); err != nil {
+			return nil, err
+		}
+	}
+
 	return ret, nil
 }
@@ -0,0 +1,110 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gwos/boxspy/storage"
+)
+
+func init() {
+	storage.Register("influxdb", newFromConfig)
+}
+
+func newFromConfig(config map[string]string) (storage.Output, error) {
+	bufferDuration, err := time.ParseDuration(config["buffer_duration"])
+	if err != nil {
+		bufferDuration = 10 * time.Second
+	}
+	isSecure, _ := strconv.ParseBool(config["secure"])
+
+	var handoff HandoffConfig
+	if dir := config["handoff_dir"]; dir != "" {
+		handoff.Dir = dir
+		handoff.MaxBytes, _ = strconv.ParseInt(config["handoff_max_bytes"], 10, 64)
+		handoff.MaxAge, _ = time.ParseDuration(config["handoff_max_age"])
+	}
+
+	labelFilter := LabelFilter{
+		Allow: splitNonEmpty(config["label_allow"]),
+		Deny:  splitNonEmpty(config["label_deny"]),
+	}
+
+	return New(Config{
+		MachineName:      config["machine_name"],
+		TableName:        config["table_name"],
+		Database:         config["database"],
+		Username:         config["username"],
+		Password:         config["password"],
+		InfluxDBHost:     config["host"],
+		IsSecure:         isSecure,
+		BufferDuration:   bufferDuration,
+		RetentionPolicy:  config["retention_policy"],
+		WriteConsistency: config["write_consistency"],
+		Handoff:          handoff,
+		LabelFilter:      labelFilter,
+		Retention:        retentionSetupFromConfig(config),
+	})
+}
+
+// retentionSetupFromConfig builds a RetentionSetup from config, supporting
+// the single retention policy and single continuous query a flat config
+// section can reasonably express. retention_name/cq_name left empty
+// provision nothing, matching New's zero-value RetentionSetup default.
+func retentionSetupFromConfig(config map[string]string) RetentionSetup {
+	var setup RetentionSetup
+
+	if name := config["retention_name"]; name != "" {
+		replication, _ := strconv.Atoi(config["retention_replication"])
+		isDefault, _ := strconv.ParseBool(config["retention_default"])
+		setup.Policies = append(setup.Policies, RetentionPolicy{
+			Name:          name,
+			Duration:      config["retention_duration"],
+			Replication:   replication,
+			ShardDuration: config["retention_shard_duration"],
+			Default:       isDefault,
+		})
+	}
+
+	if name := config["cq_name"]; name != "" {
+		aggregations := make(map[string]string)
+		for _, pair := range splitNonEmpty(config["cq_aggregations"]) {
+			parts := strings.SplitN(pair, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			aggregations[parts[0]] = parts[1]
+		}
+		setup.ContinuousQueries = append(setup.ContinuousQueries, ContinuousQuery{
+			Name:         name,
+			SrcRP:        config["cq_src_rp"],
+			DstRP:        config["cq_dst_rp"],
+			Interval:     config["cq_interval"],
+			Aggregations: aggregations,
+		})
+	}
+
+	return setup
+}
+
+func splitNonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,213 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/influxql"
+)
+
+// RetentionPolicy describes one `CREATE RETENTION POLICY` boxspy should
+// provision on startup. Duration and ShardDuration take InfluxDB duration
+// literals (e.g. "24h", "7d", "INF").
+type RetentionPolicy struct {
+	Name          string
+	Duration      string
+	Replication   int
+	ShardDuration string
+	Default       bool
+}
+
+// ContinuousQuery describes one downsampling `CREATE CONTINUOUS QUERY`
+// boxspy should provision on startup. Aggregations maps a field name (e.g.
+// "cpu_cumulative_usage") to the aggregate function to downsample it with
+// (e.g. "mean", "max", "sum").
+type ContinuousQuery struct {
+	Name         string
+	SrcRP        string
+	DstRP        string
+	Interval     string
+	Aggregations map[string]string
+}
+
+// RetentionSetup bundles the retention policies and continuous queries to
+// provision at storage init, so long-running boxspy deployments can bound
+// storage growth without an external ops script.
+type RetentionSetup struct {
+	Policies          []RetentionPolicy
+	ContinuousQueries []ContinuousQuery
+}
+
+// provisionRetention issues the configured `CREATE RETENTION POLICY` and
+// `CREATE CONTINUOUS QUERY` statements. It's idempotent: policies that
+// already exist are altered in place rather than re-created, and continuous
+// queries that already exist by name are left untouched, since InfluxDB has
+// no ALTER for those.
+func (self *influxdbStorage) provisionRetention(setup RetentionSetup) error {
+	existingRPs, err := self.listRetentionPolicyNames()
+	if err != nil {
+		return fmt.Errorf("failed to list retention policies: %s", err)
+	}
+	for _, rp := range setup.Policies {
+		stmt := retentionPolicyStatement(rp, self.database, existingRPs[rp.Name])
+		if err := self.execStatement(stmt); err != nil {
+			return fmt.Errorf("failed to provision retention policy %s: %s", rp.Name, err)
+		}
+		if rp.Default {
+			self.retentionPolicy = rp.Name
+		}
+	}
+
+	existingCQs, err := self.listContinuousQueryNames()
+	if err != nil {
+		return fmt.Errorf("failed to list continuous queries: %s", err)
+	}
+	for _, cq := range setup.ContinuousQueries {
+		if existingCQs[cq.Name] {
+			continue
+		}
+		stmt, err := continuousQueryStatement(cq, self.database, self.tableName)
+		if err != nil {
+			return fmt.Errorf("failed to build continuous query %s: %s", cq.Name, err)
+		}
+		if err := self.execStatement(stmt); err != nil {
+			return fmt.Errorf("failed to provision continuous query %s: %s", cq.Name, err)
+		}
+	}
+	return nil
+}
+
+func (self *influxdbStorage) execStatement(stmt string) error {
+	resp, err := self.client.Query(client.NewQuery(stmt, self.database, ""))
+	if err != nil {
+		return err
+	}
+	return resp.Error()
+}
+
+func (self *influxdbStorage) listRetentionPolicyNames() (map[string]bool, error) {
+	resp, err := self.client.Query(client.NewQuery(
+		fmt.Sprintf("SHOW RETENTION POLICIES ON %s", influxql.QuoteIdent(self.database)), "", ""))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+	names := make(map[string]bool)
+	for _, result := range resp.Results {
+		for _, s := range result.Series {
+			for _, row := range s.Values {
+				if len(row) == 0 {
+					continue
+				}
+				if name, ok := row[0].(string); ok {
+					names[name] = true
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+func (self *influxdbStorage) listContinuousQueryNames() (map[string]bool, error) {
+	resp, err := self.client.Query(client.NewQuery("SHOW CONTINUOUS QUERIES", "", ""))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+	names := make(map[string]bool)
+	for _, result := range resp.Results {
+		for _, s := range result.Series {
+			// SHOW CONTINUOUS QUERIES groups results by database name.
+			if s.Name != self.database {
+				continue
+			}
+			for _, row := range s.Values {
+				if len(row) == 0 {
+					continue
+				}
+				if name, ok := row[0].(string); ok {
+					names[name] = true
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// allowedAggregations are the only functions callers may name in a
+// ContinuousQuery. The function name is interpolated directly into the
+// generated InfluxQL (unlike identifiers, InfluxQL has no quoting for
+// function names), so it must come from a fixed allowlist rather than be
+// passed through unchecked.
+var allowedAggregations = map[string]bool{
+	"mean":  true,
+	"max":   true,
+	"min":   true,
+	"sum":   true,
+	"count": true,
+}
+
+func retentionPolicyStatement(rp RetentionPolicy, database string, exists bool) string {
+	verb := "CREATE"
+	if exists {
+		verb = "ALTER"
+	}
+	replication := rp.Replication
+	if replication <= 0 {
+		replication = 1
+	}
+	stmt := fmt.Sprintf("%s RETENTION POLICY %s ON %s DURATION %s REPLICATION %d",
+		verb, influxql.QuoteIdent(rp.Name), influxql.QuoteIdent(database), rp.Duration, replication)
+	if rp.ShardDuration != "" {
+		stmt += fmt.Sprintf(" SHARD DURATION %s", rp.ShardDuration)
+	}
+	if rp.Default {
+		stmt += " DEFAULT"
+	}
+	return stmt
+}
+
+func continuousQueryStatement(cq ContinuousQuery, database, measurement string) (string, error) {
+	if len(cq.Aggregations) == 0 {
+		return "", fmt.Errorf("no aggregations configured")
+	}
+	fields := make([]string, 0, len(cq.Aggregations))
+	for field, fn := range cq.Aggregations {
+		if !allowedAggregations[fn] {
+			return "", fmt.Errorf("unsupported aggregation function %q for field %q", fn, field)
+		}
+		fields = append(fields, fmt.Sprintf("%s(%s) AS %s", fn, influxql.QuoteIdent(field), influxql.QuoteIdent(field)))
+	}
+	// Sort so the generated statement is deterministic across runs, which
+	// makes it safe to log and easy to diff against what's already deployed.
+	sort.Strings(fields)
+
+	return fmt.Sprintf(
+		"CREATE CONTINUOUS QUERY %s ON %s BEGIN SELECT %s INTO %s.%s FROM %s.%s GROUP BY time(%s), * END",
+		influxql.QuoteIdent(cq.Name), influxql.QuoteIdent(database),
+		strings.Join(fields, ", "),
+		influxql.QuoteIdent(cq.DstRP), influxql.QuoteIdent(measurement),
+		influxql.QuoteIdent(cq.SrcRP), influxql.QuoteIdent(measurement),
+		cq.Interval,
+	), nil
+}
@@ -0,0 +1,189 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kafka implements a storage.Output that publishes container stats
+// as JSON-encoded messages to a Kafka topic.
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/gwos/boxspy/info"
+	"github.com/gwos/boxspy/storage"
+)
+
+func init() {
+	storage.Register("kafka", newFromConfig)
+}
+
+func newFromConfig(config map[string]string) (storage.Output, error) {
+	bufferDuration, err := time.ParseDuration(config["buffer_duration"])
+	if err != nil {
+		bufferDuration = 10 * time.Second
+	}
+	var brokers []string
+	if config["brokers"] != "" {
+		brokers = strings.Split(config["brokers"], ",")
+	}
+	return New(config["machine_name"], config["topic"], brokers, bufferDuration)
+}
+
+type networkMessage struct {
+	RxBytes  uint64 `json:"rx_bytes"`
+	RxErrors uint64 `json:"rx_errors"`
+	TxBytes  uint64 `json:"tx_bytes"`
+	TxErrors uint64 `json:"tx_errors"`
+}
+
+type fsMessage struct {
+	Device string `json:"fs_device"`
+	Limit  uint64 `json:"fs_limit"`
+	Usage  uint64 `json:"fs_usage"`
+}
+
+type statMessage struct {
+	Timestamp     time.Time       `json:"timestamp"`
+	Machine       string          `json:"machine"`
+	Container     string          `json:"container_name"`
+	CpuUsage      uint64          `json:"cpu_cumulative_usage"`
+	MemoryUsage   uint64          `json:"memory_usage"`
+	MemoryWorking uint64          `json:"memory_working_set"`
+	Network       *networkMessage `json:"network,omitempty"`
+	Filesystem    []fsMessage     `json:"filesystem,omitempty"`
+}
+
+type kafkaStorage struct {
+	producer       sarama.SyncProducer
+	topic          string
+	machineName    string
+	bufferDuration time.Duration
+	lastWrite      time.Time
+	messages       []statMessage
+	lock           sync.Mutex
+	readyToFlush   func() bool
+}
+
+// New returns an output that publishes one JSON message per container stat
+// to topic on the given Kafka brokers.
+func New(machineName, topic string, brokers []string, bufferDuration time.Duration) (*kafkaStorage, error) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	ret := &kafkaStorage{
+		producer:       producer,
+		topic:          topic,
+		machineName:    machineName,
+		bufferDuration: bufferDuration,
+		lastWrite:      time.Now(),
+		messages:       make([]statMessage, 0),
+	}
+	ret.readyToFlush = ret.defaultReadyToFlush
+	return ret, nil
+}
+
+func (self *kafkaStorage) defaultReadyToFlush() bool {
+	return time.Since(self.lastWrite) >= self.bufferDuration
+}
+
+func (self *kafkaStorage) OverrideReadyToFlush(readyToFlush func() bool) {
+	self.readyToFlush = readyToFlush
+}
+
+func (self *kafkaStorage) containerStatsToMessage(ref info.ContainerReference, stats *info.ContainerStats) statMessage {
+	containerName := ref.Name
+	if len(ref.Aliases) > 0 {
+		containerName = ref.Aliases[0]
+	}
+
+	msg := statMessage{
+		Timestamp:     stats.Timestamp,
+		Machine:       self.machineName,
+		Container:     containerName,
+		CpuUsage:      stats.Cpu.Usage.Total,
+		MemoryUsage:   stats.Memory.Usage,
+		MemoryWorking: stats.Memory.WorkingSet,
+	}
+	if stats.Network != nil {
+		msg.Network = &networkMessage{
+			RxBytes:  stats.Network.RxBytes,
+			RxErrors: stats.Network.RxErrors,
+			TxBytes:  stats.Network.TxBytes,
+			TxErrors: stats.Network.TxErrors,
+		}
+	}
+	for _, fsStat := range stats.Filesystem {
+		msg.Filesystem = append(msg.Filesystem, fsMessage{
+			Device: fsStat.Device,
+			Limit:  fsStat.Limit,
+			Usage:  fsStat.Usage,
+		})
+	}
+	return msg
+}
+
+func (self *kafkaStorage) AddStats(ref info.ContainerReference, stats *info.ContainerStats) error {
+	if stats == nil || stats.Cpu == nil || stats.Memory == nil {
+		return nil
+	}
+	var toFlush []statMessage
+	func() {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		self.messages = append(self.messages, self.containerStatsToMessage(ref, stats))
+		if self.readyToFlush() {
+			toFlush = self.messages
+			self.messages = make([]statMessage, 0)
+			self.lastWrite = time.Now()
+		}
+	}()
+	if len(toFlush) > 0 {
+		if err := self.writeBatch(toFlush); err != nil {
+			return fmt.Errorf("failed to write stats to kafka - %s", err)
+		}
+	}
+	return nil
+}
+
+func (self *kafkaStorage) writeBatch(messages []statMessage) error {
+	for _, msg := range messages {
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if _, _, err := self.producer.SendMessage(&sarama.ProducerMessage{
+			Topic: self.topic,
+			Value: sarama.ByteEncoder(payload),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *kafkaStorage) RecentStats(containerName string, numStats int) ([]*info.ContainerStats, error) {
+	return nil, fmt.Errorf("kafka: RecentStats is not supported, kafka is a write-only output")
+}
+
+func (self *kafkaStorage) Close() error {
+	return self.producer.Close()
+}
@@ -0,0 +1,93 @@
+// Copyright 2014 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storage defines the pluggable output interface boxspy writes
+// container stats to, and a registry that lets output backends register
+// themselves by name, mirroring Telegraf's output plugin model.
+package storage
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gwos/boxspy/info"
+)
+
+// Output is implemented by every storage backend boxspy can write stats to.
+type Output interface {
+	// AddStats writes the stats for a single container, buffering as the
+	// implementation sees fit until OverrideReadyToFlush's function (or its
+	// own default) says it's time to flush.
+	AddStats(ref info.ContainerReference, stats *info.ContainerStats) error
+
+	// RecentStats returns the numStats most recent stats recorded for
+	// containerName, oldest first. Not every backend supports reads; those
+	// that don't should return an error.
+	RecentStats(containerName string, numStats int) ([]*info.ContainerStats, error)
+
+	// OverrideReadyToFlush lets callers replace the backend's default
+	// buffering policy.
+	OverrideReadyToFlush(readyToFlush func() bool)
+
+	// Close releases any resources held by the output. Stats still buffered
+	// by AddStats and not yet flushed are not written.
+	Close() error
+}
+
+// Factory constructs an Output from its config section. config carries
+// whatever keys the backend documents; unknown keys should be ignored so
+// config files can list options for backends other than the one in question.
+type Factory func(config map[string]string) (Output, error)
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]Factory)
+)
+
+// Register makes an output backend available under name. It is meant to be
+// called from a backend package's init(), the way Telegraf output plugins
+// register themselves. Registering the same name twice panics, since it
+// almost certainly indicates two packages fighting over one config section.
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("storage: output %q already registered", name))
+	}
+	registry[name] = factory
+}
+
+// New builds the named output from config. The caller must have imported the
+// backend package (for its registering init()) before calling New.
+func New(name string, config map[string]string) (Output, error) {
+	registryLock.Lock()
+	factory, ok := registry[name]
+	registryLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("storage: unknown output %q", name)
+	}
+	return factory(config)
+}
+
+// Registered returns the names of all currently registered outputs, mostly
+// useful for validating config and for error messages.
+func Registered() []string {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	return names
+}